@@ -17,28 +17,104 @@ void GoIOS_createManager();
 
 void GoIOS_startAccelerometer(float interval);
 void GoIOS_stopAccelerometer();
-void GoIOS_readAccelerometer(int64_t* timestamp, float* vector);
+int GoIOS_waitAccelerometer(int64_t* timestamp, float* vector);
+
+void GoIOS_startGyro(float interval);
+void GoIOS_stopGyro();
+int GoIOS_waitGyro(int64_t* timestamp, float* vector);
+
+void GoIOS_startMagneto(float interval);
+void GoIOS_stopMagneto();
+int GoIOS_waitMagneto(int64_t* timestamp, float* vector);
+
+void GoIOS_startDeviceMotion(float interval);
+void GoIOS_stopDeviceMotion();
+int GoIOS_waitDeviceMotion(int64_t* timestamp, float* attitude, float* gravity, float* acceleration);
 
 void GoIOS_destroyManager();
 */
 import "C"
 import (
 	"fmt"
-	"sync"
 	"time"
 	"unsafe"
 )
 
-var channels struct {
-	sync.Mutex
-	acceleroDone chan struct{}
+// sensorState tracks a single enabled sensor. finished is closed by the
+// sensor's run goroutine once it has observed the stop request and
+// drained its last sample, which lets disable block until it is safe
+// for the sensor to be enabled again.
+type sensorState struct {
+	finished chan struct{}
+}
+
+// command is sent to manager.run, the single goroutine that owns every
+// Core Motion interaction. Serializing enable, disable, and shutdown
+// through this goroutine — rather than guarding shared state with a
+// mutex — is what makes it safe to re-enable a sensor immediately after
+// disabling it: see golang.org/issue/12501 for the analogous bug on
+// Android that this mirrors the fix for.
+type command struct {
+	enable  bool
+	disable bool
+	sender  interface{} // Sender, or BatchSender when batched is set
+	typ     Type
+	delay   time.Duration
+	batched bool
+	// maxLatency is only meaningful when batched is set; see EnableBatched.
+	maxLatency time.Duration
+	errc       chan error
 }
 
 type manager struct {
+	cmds chan command
+	// done is closed once run has returned, so a send racing with (or
+	// arriving after) shutdown doesn't block on a channel nobody is
+	// reading from anymore.
+	done chan struct{}
 }
 
+var errClosed = fmt.Errorf("sensor: manager is closed")
+
 func (m *manager) initialize() {
+	m.cmds = make(chan command)
+	m.done = make(chan struct{})
+	go m.run()
+}
+
+// send delivers cmd to run, or returns errClosed if run has already
+// exited. A successful send guarantees run received cmd and will reply
+// on cmd.errc.
+func (m *manager) send(cmd command) error {
+	select {
+	case m.cmds <- cmd:
+		return <-cmd.errc
+	case <-m.done:
+		return errClosed
+	}
+}
+
+func (m *manager) run() {
+	defer close(m.done)
 	C.GoIOS_createManager()
+	states := make(map[Type]*sensorState)
+	for cmd := range m.cmds {
+		switch {
+		case cmd.enable:
+			cmd.errc <- m.doEnable(states, cmd)
+		case cmd.disable:
+			cmd.errc <- m.doDisable(states, cmd.typ)
+		default:
+			// Shutdown: drain outstanding sensors before tearing down
+			// the CMMotionManager.
+			for t := range states {
+				m.doDisable(states, t)
+			}
+			C.GoIOS_destroyManager()
+			cmd.errc <- nil
+			return
+		}
+	}
 }
 
 // minDelay is the minimum delay allowed.
@@ -56,79 +132,223 @@ func (m *manager) initialize() {
 const minDelay = 10 * time.Millisecond
 
 func (m *manager) enable(s Sender, t Type, delay time.Duration) error {
-	channels.Lock()
-	defer channels.Unlock()
+	return m.send(command{enable: true, sender: s, typ: t, delay: delay, errc: make(chan error)})
+}
 
+func (m *manager) enableBatched(s BatchSender, t Type, delay, maxLatency time.Duration) error {
+	return m.send(command{enable: true, sender: s, typ: t, delay: delay, batched: true, maxLatency: maxLatency, errc: make(chan error)})
+}
+
+func (m *manager) disable(t Type) error {
+	return m.send(command{disable: true, typ: t, errc: make(chan error)})
+}
+
+// doEnable and doDisable run exclusively on the manager.run goroutine, so
+// they need no locking of their own.
+
+func (m *manager) doEnable(states map[Type]*sensorState, cmd command) error {
+	t := cmd.typ
+	delay := cmd.delay
 	if delay < minDelay {
 		delay = minDelay
 	}
 
+	if states[t] != nil {
+		return fmt.Errorf("sensor: cannot enable; %v sensor is already enabled", t)
+	}
+	if cmd.batched && t != Accelerometer {
+		return fmt.Errorf("sensor: batched delivery is not supported for %v", t)
+	}
+
+	// Core Motion honors accelerometerUpdateInterval (and its gyro,
+	// magnetometer, and device motion equivalents) exactly, so there is
+	// no need to poll or dedup by timestamp on the Go side.
+	interval := float64(delay) / float64(time.Second)
+	finished := make(chan struct{})
+
 	switch t {
 	case Accelerometer:
-		if channels.acceleroDone != nil {
-			return fmt.Errorf("sensor: cannot enable; %v sensor is already enabled", t)
-		}
 		// TODO(jbd): Check if accelerometer is available.
-		interval := float64(delay) / float64(time.Second)
 		C.GoIOS_startAccelerometer(C.float(interval))
-		channels.acceleroDone = make(chan struct{})
-		go m.runAccelerometer(s, delay, channels.acceleroDone)
+		if cmd.batched {
+			go m.runAccelerometerBatched(cmd.sender.(BatchSender), cmd.maxLatency, finished)
+		} else {
+			go m.runAccelerometer(cmd.sender.(Sender), finished)
+		}
 	case Gyroscope:
+		C.GoIOS_startGyro(C.float(interval))
+		go m.runGyro(cmd.sender.(Sender), finished)
 	case Magnetometer:
+		C.GoIOS_startMagneto(C.float(interval))
+		go m.runMagneto(cmd.sender.(Sender), finished)
+	case DeviceMotion:
+		C.GoIOS_startDeviceMotion(C.float(interval))
+		go m.runDeviceMotion(cmd.sender.(Sender), finished)
 	default:
 		return fmt.Errorf("sensor: unknown sensor type: %v", t)
 	}
+	states[t] = &sensorState{finished: finished}
 	return nil
 }
 
-func (m *manager) disable(t Type) error {
-	channels.Lock()
-	defer channels.Unlock()
+func (m *manager) doDisable(states map[Type]*sensorState, t Type) error {
+	st := states[t]
+	if st == nil {
+		return fmt.Errorf("sensor: cannot disable; %v sensor is not enabled", t)
+	}
+	delete(states, t)
 
+	// Stopping posts a shutdown token that wakes the blocked
+	// GoIOS_wait* call in the run goroutine.
 	switch t {
 	case Accelerometer:
-		if channels.acceleroDone == nil {
-			return fmt.Errorf("sensor: cannot disable; %v sensor is not enabled", t)
-		}
-		close(channels.acceleroDone)
-		channels.acceleroDone = nil
 		C.GoIOS_stopAccelerometer()
 	case Gyroscope:
+		C.GoIOS_stopGyro()
 	case Magnetometer:
+		C.GoIOS_stopMagneto()
+	case DeviceMotion:
+		C.GoIOS_stopDeviceMotion()
 	default:
 		return fmt.Errorf("sensor: unknown sensor type: %v", t)
 	}
+
+	// Wait for the run goroutine to actually exit before returning, so a
+	// sensor can always be re-enabled as soon as disable returns.
+	<-st.finished
 	return nil
 }
 
-func (m *manager) runAccelerometer(s Sender, d time.Duration, done chan struct{}) {
+func (m *manager) runAccelerometer(s Sender, finished chan struct{}) {
+	defer close(finished)
 	var timestamp C.int64_t
 	var ev [3]C.float
-	var lastTimestamp int64
+	for C.GoIOS_waitAccelerometer((*C.int64_t)(unsafe.Pointer(&timestamp)), (*C.float)(unsafe.Pointer(&ev[0]))) != 0 {
+		// TODO(jbd): Do we need to convert the values to another unit?
+		// How does iOS units compare to the Android units.
+		s.Send(Event{
+			Sensor:    Accelerometer,
+			Timestamp: int64(timestamp),
+			Data:      []float64{float64(ev[0]), float64(ev[1]), float64(ev[2])},
+		})
+	}
+}
+
+// runAccelerometerBatched coalesces every sample pulled from the ring
+// buffer since the last delivery into a single batch, flushing whenever
+// maxLatency has elapsed since the first sample of the pending batch so
+// a consumer never waits longer than that to see new data even if the
+// stream falls behind the sensor's sampling rate.
+func (m *manager) runAccelerometerBatched(s BatchSender, maxLatency time.Duration, finished chan struct{}) {
+	defer close(finished)
+
+	evc := make(chan Event)
+	go func() {
+		defer close(evc)
+		var timestamp C.int64_t
+		var ev [3]C.float
+		for C.GoIOS_waitAccelerometer((*C.int64_t)(unsafe.Pointer(&timestamp)), (*C.float)(unsafe.Pointer(&ev[0]))) != 0 {
+			evc <- Event{
+				Sensor:    Accelerometer,
+				Timestamp: int64(timestamp),
+				Data:      []float64{float64(ev[0]), float64(ev[1]), float64(ev[2])},
+			}
+		}
+	}()
+
+	var batch []Event
+	timer := time.NewTimer(maxLatency)
+	defer timer.Stop()
 	for {
 		select {
-		case <-done:
-			return
-		default:
-			C.GoIOS_readAccelerometer((*C.int64_t)(unsafe.Pointer(&timestamp)), (*C.float)(unsafe.Pointer(&ev[0])))
-			t := int64(timestamp)
-			if t > lastTimestamp {
-				// TODO(jbd): Do we need to convert the values to another unit?
-				// How does iOS units compare to the Android units.
-				s.Send(Event{
-					Sensor:    Accelerometer,
-					Timestamp: t,
-					Data:      []float64{float64(ev[0]), float64(ev[1]), float64(ev[2])},
-				})
-				lastTimestamp = t
-				time.Sleep(d / 2)
+		case e, ok := <-evc:
+			if !ok {
+				if len(batch) > 0 {
+					s.SendBatch(batch)
+				}
+				return
+			}
+			if len(batch) == 0 {
+				resetTimer(timer, maxLatency)
 			}
+			batch = append(batch, e)
+		case <-timer.C:
+			if len(batch) > 0 {
+				s.SendBatch(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+// resetTimer safely rearms t for d more, per the Timer.Reset contract:
+// Reset may only be called on a timer that is stopped and, if it had
+// already expired, drained. Calling Reset on a still-running timer (as
+// happens here whenever a new batch starts before the previous deadline
+// has fired) could otherwise leave a stale value in t.C that surfaces as
+// an early, spurious flush on a later select iteration.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
 		}
 	}
+	t.Reset(d)
+}
+
+func (m *manager) runGyro(s Sender, finished chan struct{}) {
+	defer close(finished)
+	var timestamp C.int64_t
+	var ev [3]C.float
+	for C.GoIOS_waitGyro((*C.int64_t)(unsafe.Pointer(&timestamp)), (*C.float)(unsafe.Pointer(&ev[0]))) != 0 {
+		s.Send(Event{
+			Sensor:    Gyroscope,
+			Timestamp: int64(timestamp),
+			Data:      []float64{float64(ev[0]), float64(ev[1]), float64(ev[2])},
+		})
+	}
+}
+
+func (m *manager) runMagneto(s Sender, finished chan struct{}) {
+	defer close(finished)
+	var timestamp C.int64_t
+	var ev [3]C.float
+	for C.GoIOS_waitMagneto((*C.int64_t)(unsafe.Pointer(&timestamp)), (*C.float)(unsafe.Pointer(&ev[0]))) != 0 {
+		s.Send(Event{
+			Sensor:    Magnetometer,
+			Timestamp: int64(timestamp),
+			Data:      []float64{float64(ev[0]), float64(ev[1]), float64(ev[2])},
+		})
+	}
+}
+
+// runDeviceMotion reports the attitude (roll, pitch, yaw), gravity vector,
+// and user acceleration vector produced by Core Motion's own sensor
+// fusion, which is considerably less noisy than fusing the raw
+// accelerometer, gyroscope, and magnetometer streams in Go.
+func (m *manager) runDeviceMotion(s Sender, finished chan struct{}) {
+	defer close(finished)
+	var timestamp C.int64_t
+	var attitude, gravity, acceleration [3]C.float
+	for C.GoIOS_waitDeviceMotion(
+		(*C.int64_t)(unsafe.Pointer(&timestamp)),
+		(*C.float)(unsafe.Pointer(&attitude[0])),
+		(*C.float)(unsafe.Pointer(&gravity[0])),
+		(*C.float)(unsafe.Pointer(&acceleration[0])),
+	) != 0 {
+		s.Send(Event{
+			Sensor:    DeviceMotion,
+			Timestamp: int64(timestamp),
+			Data: []float64{
+				float64(attitude[0]), float64(attitude[1]), float64(attitude[2]),
+				float64(gravity[0]), float64(gravity[1]), float64(gravity[2]),
+				float64(acceleration[0]), float64(acceleration[1]), float64(acceleration[2]),
+			},
+		})
+	}
 }
 
-// TODO(jbd): Remove close?
 func (m *manager) close() error {
-	C.GoIOS_destroyManager()
-	return nil
+	return m.send(command{errc: make(chan error)})
 }
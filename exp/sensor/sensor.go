@@ -0,0 +1,110 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sensor defines types to read data from different sensors.
+package sensor
+
+import "time"
+
+// Type is a sensor type.
+type Type int32
+
+const (
+	// Accelerometer indicates a sensor that measures the acceleration
+	// force in g (1 g is about 9.81 m/s^2) applied to a device on all
+	// three physical axes, including the force of gravity.
+	Accelerometer Type = iota
+
+	// Gyroscope indicates a sensor that measures a device's rate of
+	// rotation in rad/s around each of the three physical axes.
+	Gyroscope
+
+	// Magnetometer indicates a sensor that measures the ambient
+	// magnetic field in microteslas along the three physical axes.
+	Magnetometer
+
+	// DeviceMotion indicates the platform's fused attitude sensor,
+	// combining accelerometer, gyroscope, and (where available)
+	// magnetometer input into a single, low-noise attitude reading
+	// rather than one derived in Go from the raw streams.
+	DeviceMotion
+)
+
+func (t Type) String() string {
+	switch t {
+	case Accelerometer:
+		return "acceleration"
+	case Gyroscope:
+		return "gyroscope"
+	case Magnetometer:
+		return "magnetic field"
+	case DeviceMotion:
+		return "device motion"
+	}
+	return "unknown"
+}
+
+// Event represents a single sensor sample.
+//
+// The contents of Data depend on Sensor:
+//
+//	Accelerometer: x, y, z acceleration in g, including gravity.
+//	Gyroscope: x, y, z rate of rotation in rad/s.
+//	Magnetometer: x, y, z ambient magnetic field in microteslas.
+//	DeviceMotion: roll, pitch, yaw attitude in radians, followed by
+//	the x, y, z gravity vector and the x, y, z user acceleration
+//	vector, both in g.
+type Event struct {
+	Sensor    Type
+	Timestamp int64
+	Data      []float64
+}
+
+// Sender is the interface that wraps the Send method.
+//
+// Send is called once per sensor event.
+type Sender interface {
+	Send(e Event)
+}
+
+// BatchSender is the interface that wraps the SendBatch method.
+//
+// SendBatch is called with every event accumulated, oldest first, since
+// the previous call.
+type BatchSender interface {
+	SendBatch(e []Event)
+}
+
+var managerInst manager
+
+func init() {
+	managerInst.initialize()
+}
+
+// Enable enables the sensor of the given type, delivering events to s no
+// more often than delay.
+func Enable(s Sender, t Type, delay time.Duration) error {
+	return managerInst.enable(s, t, delay)
+}
+
+// EnableBatched is like Enable, but coalesces every event observed since
+// the last delivery into a single call to s.SendBatch, rather than
+// calling Send once per event. maxLatency bounds how long events may be
+// buffered before a batch is flushed, so that clients of high-frequency
+// sensors can amortize the per-event delivery cost without waiting
+// indefinitely for a batch to fill up. Only the Accelerometer supports
+// batched delivery; for any other type EnableBatched returns an error.
+func EnableBatched(s BatchSender, t Type, delay, maxLatency time.Duration) error {
+	return managerInst.enableBatched(s, t, delay, maxLatency)
+}
+
+// Disable disables a previously enabled sensor.
+func Disable(t Type) error {
+	return managerInst.disable(t)
+}
+
+// Close releases the resources associated with sensor management.
+func Close() error {
+	return managerInst.close()
+}